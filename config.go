@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+	"gopkg.in/yaml.v2"
+)
+
+// Config lists the certificates letsencrypt-with-etcd should obtain and keep renewed.
+type Config struct {
+	Certificates []CertConfig `yaml:"certificates" json:"certificates"`
+}
+
+// CertConfig describes a single certificate.
+type CertConfig struct {
+	Domains    []string `yaml:"domains" json:"domains"`
+	KeyType    string   `yaml:"key_type" json:"key_type"`
+	MustStaple bool     `yaml:"must_staple" json:"must_staple"`
+	Directory  string   `yaml:"directory" json:"directory"`
+}
+
+// loadConfig reads a list of certificates to manage from a YAML or JSON file,
+// picking the format based on the file extension (defaulting to YAML).
+func loadConfig(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg Config
+	if strings.HasSuffix(path, ".json") {
+		err = json.Unmarshal(b, &cfg)
+	} else {
+		err = yaml.Unmarshal(b, &cfg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	for i, cert := range cfg.Certificates {
+		if len(cert.Domains) == 0 {
+			return nil, fmt.Errorf("certificate #%d in %s has no domains", i, path)
+		}
+		if _, err := cert.keyType(); err != nil {
+			return nil, fmt.Errorf("certificate #%d in %s: %w", i, path, err)
+		}
+	}
+
+	return &cfg, nil
+}
+
+// keyType maps key_type to a certcrypto.KeyType, defaulting to the same
+// RSA2048 lego's own CLI defaults to when key_type is unset.
+func (cc CertConfig) keyType() (certcrypto.KeyType, error) {
+	switch strings.ToUpper(cc.KeyType) {
+	case "":
+		return certcrypto.RSA2048, nil
+	case "RSA2048":
+		return certcrypto.RSA2048, nil
+	case "RSA4096":
+		return certcrypto.RSA4096, nil
+	case "EC256":
+		return certcrypto.EC256, nil
+	case "EC384":
+		return certcrypto.EC384, nil
+	default:
+		return "", fmt.Errorf("unknown key_type %q", cc.KeyType)
+	}
+}
+
+// etcdDirectory returns the etcd key prefix this certificate is stored under,
+// falling back to the global --directory flag if it doesn't set its own.
+func (cc CertConfig) etcdDirectory() string {
+	if cc.Directory == "" {
+		return *certificateDirectory
+	}
+	return strings.TrimSuffix(cc.Directory, "/") + "/"
+}
@@ -0,0 +1,201 @@
+// Package etcdcert serves TLS certificates that letsencrypt-with-etcd writes to
+// etcd, so any Go TLS server in the fleet can read them without running its own
+// ACME client or managing files on disk.
+package etcdcert
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"golang.org/x/crypto/ocsp"
+)
+
+// RenewalFraction is the denominator of the fraction of a certificate's total
+// validity window (counting back from NotAfter) inside which it's considered
+// due for renewal: a certificate is due inside its last 1/RenewalFraction.
+// This matches the threshold the letsencrypt-with-etcd CLI uses itself.
+const RenewalFraction = 3
+
+// Manager serves a certificate pair kept in etcd. Plug GetCertificate into a
+// crypto/tls.Config to have a TLS server pick up renewals with no restart.
+type Manager struct {
+	client       *clientv3.Client
+	fullChainKey string
+	keyKey       string
+	ocspKey      string
+	onRenewalDue func()
+
+	cert atomic.Value // *tls.Certificate
+}
+
+// Option configures a Manager.
+type Option func(*Manager)
+
+// WithRenewalCallback registers a function that's called after every reload
+// where the currently loaded certificate is inside its last 1/RenewalFraction
+// of validity, so the caller can trigger a renewal in-process instead of
+// polling. The callback runs on the goroutine doing the reload: the caller of
+// NewManager for the initial load, the watch goroutine afterwards. It should
+// return quickly or hand off to its own goroutine. It's the caller's responsibility to avoid
+// overlapping renewals, e.g. by using an etcd lock.
+func WithRenewalCallback(f func()) Option {
+	return func(m *Manager) {
+		m.onRenewalDue = f
+	}
+}
+
+// WithOCSPStapling makes the Manager watch ocspKey (as returned by OCSPKey)
+// and staple its contents onto the certificate returned by GetCertificate.
+// A missing OCSP response, or one for a different certificate serial, is not
+// an error; the certificate is just served without a staple until a matching
+// one is cached. The response's NextUpdate is not checked.
+func WithOCSPStapling(ocspKey string) Option {
+	return func(m *Manager) {
+		m.ocspKey = ocspKey
+	}
+}
+
+// Keys returns the etcd keys letsencrypt-with-etcd stores a certificate's
+// fullchain and private key under, given the same --directory and primary
+// domain the CLI was run with.
+func Keys(directory, domain string) (fullChainKey, keyKey string) {
+	return directory + domain + "-fullchain.pem", directory + domain + "-key.pem"
+}
+
+// ArchiveKeys returns the etcd keys a revoked certificate's fullchain,
+// private key and cached OCSP response are moved to, keyed by domain and the
+// revoked certificate's expiry so history for a domain accumulates instead
+// of being overwritten.
+func ArchiveKeys(domain string, notAfter time.Time) (fullChainKey, keyKey, ocspKey string) {
+	prefix := fmt.Sprintf("/letsencrypt-with-etcd/archive/%s/%d/", domain, notAfter.Unix())
+	return prefix + "fullchain.pem", prefix + "key.pem", prefix + "ocsp.der"
+}
+
+// OCSPKey returns the etcd key a certificate's cached OCSP response is stored
+// under, given the same --directory and primary domain the CLI was run with.
+func OCSPKey(directory, domain string) string {
+	return directory + domain + "-ocsp.der"
+}
+
+// NewManager loads the certificate stored at fullChainKey/keyKey and starts
+// watching etcd for changes, keeping the loaded certificate up to date.
+func NewManager(ctx context.Context, client *clientv3.Client, fullChainKey, keyKey string, opts ...Option) (*Manager, error) {
+	m := &Manager{
+		client:       client,
+		fullChainKey: fullChainKey,
+		keyKey:       keyKey,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	if err := m.reload(ctx); err != nil {
+		return nil, err
+	}
+
+	go m.watch(ctx)
+
+	return m, nil
+}
+
+// GetCertificate implements the signature required by tls.Config.GetCertificate.
+func (m *Manager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, _ := m.cert.Load().(*tls.Certificate)
+	if cert == nil {
+		return nil, fmt.Errorf("etcdcert: no certificate loaded yet")
+	}
+	return cert, nil
+}
+
+func (m *Manager) watch(ctx context.Context) {
+	fullChainCh := m.client.Watch(ctx, m.fullChainKey)
+	keyCh := m.client.Watch(ctx, m.keyKey)
+	var ocspCh clientv3.WatchChan
+	if m.ocspKey != "" {
+		ocspCh = m.client.Watch(ctx, m.ocspKey)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case _, ok := <-fullChainCh:
+			if !ok {
+				return
+			}
+		case _, ok := <-keyCh:
+			if !ok {
+				return
+			}
+		case _, ok := <-ocspCh:
+			if !ok {
+				return
+			}
+		}
+		if err := m.reload(ctx); err != nil {
+			log.Printf("etcdcert: failed to reload %s / %s: %v", m.fullChainKey, m.keyKey, err)
+		}
+	}
+}
+
+func (m *Manager) reload(ctx context.Context) error {
+	fcResp, err := m.client.Get(ctx, m.fullChainKey)
+	if err != nil {
+		return fmt.Errorf("failed to fetch %s: %w", m.fullChainKey, err)
+	}
+	keyResp, err := m.client.Get(ctx, m.keyKey)
+	if err != nil {
+		return fmt.Errorf("failed to fetch %s: %w", m.keyKey, err)
+	}
+	if len(fcResp.Kvs) == 0 || len(keyResp.Kvs) == 0 {
+		// The certificate was deleted from etcd (e.g. revoked), not just
+		// not-yet-obtained. Stop serving it rather than keep handing out
+		// whatever was last loaded.
+		m.cert.Store((*tls.Certificate)(nil))
+		return fmt.Errorf("no certificate stored at %s / %s", m.fullChainKey, m.keyKey)
+	}
+
+	cert, err := tls.X509KeyPair(fcResp.Kvs[0].Value, keyResp.Kvs[0].Value)
+	if err != nil {
+		return fmt.Errorf("failed to parse certificate from etcd: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("failed to parse leaf certificate: %w", err)
+	}
+	cert.Leaf = leaf
+
+	if m.ocspKey != "" {
+		if ocspResp, err := m.client.Get(ctx, m.ocspKey); err != nil {
+			log.Printf("etcdcert: failed to fetch OCSP response at %s: %v", m.ocspKey, err)
+		} else if len(ocspResp.Kvs) > 0 {
+			if parsed, err := ocsp.ParseResponse(ocspResp.Kvs[0].Value, nil); err != nil {
+				log.Printf("etcdcert: failed to parse OCSP response at %s: %v", m.ocspKey, err)
+			} else if parsed.SerialNumber.Cmp(leaf.SerialNumber) != 0 {
+				log.Printf("etcdcert: OCSP response at %s is for a different certificate serial than %s / %s; not stapling", m.ocspKey, m.fullChainKey, m.keyKey)
+			} else {
+				cert.OCSPStaple = ocspResp.Kvs[0].Value
+			}
+		}
+	}
+
+	m.cert.Store(&cert)
+
+	if m.onRenewalDue != nil && NeedsRenewal(leaf) {
+		m.onRenewalDue()
+	}
+
+	return nil
+}
+
+// NeedsRenewal reports whether crt is inside the last 1/RenewalFraction of its
+// validity window and should be renewed.
+func NeedsRenewal(crt *x509.Certificate) bool {
+	totalValidity := crt.NotAfter.Sub(crt.NotBefore)
+	return !crt.NotAfter.Add(-totalValidity / RenewalFraction).After(time.Now())
+}
@@ -0,0 +1,119 @@
+package etcdcert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func selfSignedCert(t *testing.T, notBefore, notAfter time.Time) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return crt
+}
+
+func TestNeedsRenewal(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		name      string
+		notBefore time.Time
+		notAfter  time.Time
+		want      bool
+	}{
+		{"fresh certificate", now.Add(-time.Hour), now.Add(90 * 24 * time.Hour), false},
+		{"inside last third of validity", now.Add(-80 * 24 * time.Hour), now.Add(10 * 24 * time.Hour), true},
+		{"already expired", now.Add(-100 * 24 * time.Hour), now.Add(-time.Hour), true},
+		{"just outside the 1/3 threshold", now.Add(-58 * 24 * time.Hour), now.Add(32 * 24 * time.Hour), false},
+		{"just inside the 1/3 threshold", now.Add(-62 * 24 * time.Hour), now.Add(28 * 24 * time.Hour), true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			crt := selfSignedCert(t, c.notBefore, c.notAfter)
+			if got := NeedsRenewal(crt); got != c.want {
+				t.Errorf("NeedsRenewal() = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestKeys(t *testing.T) {
+	fullChainKey, keyKey := Keys("/letsencrypt-with-etcd/", "example.com")
+	if want := "/letsencrypt-with-etcd/example.com-fullchain.pem"; fullChainKey != want {
+		t.Errorf("fullChainKey = %q, want %q", fullChainKey, want)
+	}
+	if want := "/letsencrypt-with-etcd/example.com-key.pem"; keyKey != want {
+		t.Errorf("keyKey = %q, want %q", keyKey, want)
+	}
+}
+
+func TestOCSPKey(t *testing.T) {
+	if got, want := OCSPKey("/letsencrypt-with-etcd/", "example.com"), "/letsencrypt-with-etcd/example.com-ocsp.der"; got != want {
+		t.Errorf("OCSPKey() = %q, want %q", got, want)
+	}
+}
+
+func TestArchiveKeys(t *testing.T) {
+	notAfter := time.Unix(1700000000, 0)
+	fullChainKey, keyKey, ocspKey := ArchiveKeys("example.com", notAfter)
+	const prefix = "/letsencrypt-with-etcd/archive/example.com/1700000000/"
+	if want := prefix + "fullchain.pem"; fullChainKey != want {
+		t.Errorf("fullChainKey = %q, want %q", fullChainKey, want)
+	}
+	if want := prefix + "key.pem"; keyKey != want {
+		t.Errorf("keyKey = %q, want %q", keyKey, want)
+	}
+	if want := prefix + "ocsp.der"; ocspKey != want {
+		t.Errorf("ocspKey = %q, want %q", ocspKey, want)
+	}
+}
+
+// TestGetCertificateClearedAfterDelete exercises the atomic.Value handoff
+// reload does directly, without needing a real etcd: GetCertificate must
+// start erroring again once the loaded certificate is cleared, the same way
+// reload clears it when a certificate's keys are deleted from etcd.
+func TestGetCertificateClearedAfterDelete(t *testing.T) {
+	m := &Manager{}
+
+	if _, err := m.GetCertificate(nil); err == nil {
+		t.Fatal("GetCertificate() with nothing loaded yet: want error, got nil")
+	}
+
+	crt := selfSignedCert(t, time.Now().Add(-time.Hour), time.Now().Add(90*24*time.Hour))
+	loaded := &tls.Certificate{Leaf: crt}
+	m.cert.Store(loaded)
+
+	got, err := m.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("GetCertificate() after loading a certificate: %v", err)
+	}
+	if got != loaded {
+		t.Errorf("GetCertificate() = %v, want %v", got, loaded)
+	}
+
+	m.cert.Store((*tls.Certificate)(nil))
+
+	if _, err := m.GetCertificate(nil); err == nil {
+		t.Fatal("GetCertificate() after the certificate was cleared: want error, got nil")
+	}
+}
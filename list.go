@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// runList enumerates the certificates stored in etcd and prints their
+// domain, expiry and issuer. It walks --directory plus, if --config is
+// given, every certificate's own "directory" override, so certs that opted
+// out of the global directory still show up.
+func runList(ctx context.Context) {
+	directories := map[string]bool{*certificateDirectory: true}
+	if *configFile != "" {
+		cfg, err := loadConfig(*configFile)
+		if err != nil {
+			log.Fatalf("Failed to load %s: %v", *configFile, err)
+		}
+		for _, cert := range cfg.Certificates {
+			directories[cert.etcdDirectory()] = true
+		}
+	}
+
+	c := connectEtcd()
+	defer c.Close()
+
+	var sorted []string
+	for dir := range directories {
+		sorted = append(sorted, dir)
+	}
+	sort.Strings(sorted)
+
+	for _, dir := range sorted {
+		listDirectory(ctx, c, dir)
+	}
+}
+
+// listDirectory prints every certificate stored under dir in etcd.
+func listDirectory(ctx context.Context, c *clientv3.Client, dir string) {
+	resp, err := c.Get(ctx, dir, clientv3.WithPrefix())
+	if err != nil {
+		log.Fatalf("Failed to list %s: %v", dir, err)
+	}
+
+	for _, kv := range resp.Kvs {
+		key := string(kv.Key)
+		if !strings.HasSuffix(key, "-fullchain.pem") {
+			continue
+		}
+		domain := strings.TrimSuffix(strings.TrimPrefix(key, dir), "-fullchain.pem")
+
+		crt, err := certcrypto.ParsePEMCertificate(kv.Value)
+		if err != nil {
+			log.Printf("Failed to parse %s: %v", key, err)
+			continue
+		}
+
+		fmt.Printf("%s\texpires %s\tissuer %s\n", domain, crt.NotAfter.Format(time.RFC3339), crt.Issuer.CommonName)
+	}
+}
@@ -11,38 +11,91 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net/url"
 	"os"
 	"strings"
 	"time"
 
+	"github.com/Jille/letsencrypt-with-etcd/etcdcert"
 	"github.com/go-acme/lego/v4/certcrypto"
 	"github.com/go-acme/lego/v4/certificate"
+	"github.com/go-acme/lego/v4/challenge/dns01"
 	"github.com/go-acme/lego/v4/challenge/http01"
+	"github.com/go-acme/lego/v4/challenge/tlsalpn01"
 	"github.com/go-acme/lego/v4/lego"
+	"github.com/go-acme/lego/v4/providers/dns"
 	"github.com/go-acme/lego/v4/registration"
 	"github.com/spf13/pflag"
 	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
 )
 
 var (
-	port                 = pflag.IntP("port", "p", 8080, "Port to listen on for HTTP-01 challenges")
+	port                 = pflag.IntP("port", "p", 8080, "Port to listen on for HTTP-01 and TLS-ALPN-01 challenges")
 	email                = pflag.StringP("email", "e", "", "Your email address")
-	domains              = pflag.StringSliceP("domains", "d", nil, "List of domains to request a certificate for")
-	certificateDirectory = pflag.String("directory", "/letsencrypt-with-etcd/", "Directory to put certificates and private keys in")
+	configFile           = pflag.StringP("config", "c", "", "Path to a YAML or JSON file listing the certificates to manage")
+	certificateDirectory = pflag.String("directory", "/letsencrypt-with-etcd/", "Default directory to put certificates and private keys in; a certificate's own \"directory\" overrides this")
 	staging              = pflag.Bool("staging", false, "Whether to use LetsEncrypt staging")
+	challengeType        = pflag.String("challenge", "http-01", "Challenge type to use: http-01, dns-01 or tls-alpn-01")
+	dnsProvider          = pflag.String("dns-provider", "", "DNS provider to use for the dns-01 challenge (see lego's provider list); credentials are read from that provider's environment variables")
+	dnsResolvers         = pflag.StringSlice("dns-resolvers", nil, "Custom DNS resolvers (host:port) to use for dns-01 propagation checks, instead of the system resolver")
+	dnsDisableCP         = pflag.Bool("dns-disable-cp", false, "Disable the requirement that all authoritative nameservers agree before the dns-01 challenge is submitted")
+	dnsTimeout           = pflag.Int("dns-timeout", 10, "Timeout in seconds for DNS queries during dns-01 propagation checks")
+	lockTTL              = pflag.Int("lock-ttl", 60, "TTL in seconds of the etcd session backing the renewal lock; the lock is released automatically if the process dies within this long")
+	lockTimeout          = pflag.Duration("lock-timeout", 30*time.Second, "How long to wait to acquire the renewal lock before giving up")
+	leaderElect          = pflag.Bool("leader-elect", false, "Campaign for leadership over etcd before running, so only one replica in a Deployment/DaemonSet talks to Lets Encrypt at a time")
+	targetDomain         = pflag.String("domain", "", "Primary domain of the certificate to act on (required for revoke)")
+	revokeReason         = pflag.Int("reason", -1, "RFC 5280 reason code to include in the revocation request; -1 omits it")
+	caDirURL             = pflag.String("ca-dir-url", envDefault("CA_DIR_URL", ""), "ACME directory URL of the CA to use; defaults to Lets Encrypt (production, or staging with --staging)")
+	eabKID               = pflag.String("eab-kid", envDefault("EAB_KID", ""), "External Account Binding key identifier, required by CAs like ZeroSSL or Google Trust Services")
+	eabHMAC              = pflag.String("eab-hmac", envDefault("EAB_HMAC", ""), "External Account Binding base64url-encoded HMAC key")
+	ocspRefreshWindow    = pflag.Duration("ocsp-refresh-window", 24*time.Hour, "Refetch a certificate's OCSP response once it's within this long of its NextUpdate")
 )
 
+// userAgent is sent with every request to the ACME CA, including the ones
+// revoke.go makes directly against acme/api rather than through a lego.Client.
+const userAgent = "https://github.com/Jille/letsencrypt-with-etcd"
+
+// envDefault returns the environment variable key's value, or def if unset.
+func envDefault(key, def string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return def
+}
+
 func main() {
-	ctx := context.Background()
-	pflag.Parse()
+	if len(os.Args) < 2 {
+		log.Fatal("Usage: letsencrypt-with-etcd <obtain|renew|revoke|list|refresh-ocsp> [flags]")
+	}
+	cmd := os.Args[1]
+	if err := pflag.CommandLine.Parse(os.Args[2:]); err != nil {
+		log.Fatal(err)
+	}
 	*certificateDirectory = strings.TrimSuffix(*certificateDirectory, "/") + "/"
 
-	if len(*domains) == 0 {
-		log.Fatal("Flag --domains (-d) is required")
+	ctx := context.Background()
+
+	switch cmd {
+	case "obtain":
+		runObtainOrRenew(ctx, true)
+	case "renew":
+		runObtainOrRenew(ctx, false)
+	case "revoke":
+		runRevoke(ctx)
+	case "list":
+		runList(ctx)
+	case "refresh-ocsp":
+		runRefreshOCSP(ctx)
+	default:
+		log.Fatalf("Unknown subcommand %q; expected obtain, renew, revoke, list or refresh-ocsp", cmd)
 	}
+}
 
+// connectEtcd connects to etcd using the endpoints and credentials configured
+// through the ETCD_ENDPOINTS, ETCD_USER and ETCD_PASSWORD environment variables.
+func connectEtcd() *clientv3.Client {
 	log.Print("Connecting to etcd...")
-	var err error
 	c, err := clientv3.New(clientv3.Config{
 		Endpoints:   strings.Split(os.Getenv("ETCD_ENDPOINTS"), ","),
 		DialTimeout: 15 * time.Second,
@@ -55,33 +108,44 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to connect to etcd: %v", err)
 	}
-	defer c.Close()
 	log.Print("Connected.")
+	return c
+}
 
-	accountKey := "/letsencrypt-with-etcd/account"
-	fullChainKey := *certificateDirectory + (*domains)[0] + "-fullchain.pem"
-	keyKey := *certificateDirectory + (*domains)[0] + "-key.pem"
-
-	resp, err := c.Get(ctx, fullChainKey)
-	if err != nil {
-		log.Fatalf("Failed to fetch %s: %v", fullChainKey, err)
+// resolveCADirURL returns the ACME directory URL to use, honouring --ca-dir-url
+// and falling back to Lets Encrypt production or staging.
+func resolveCADirURL() string {
+	if *caDirURL != "" {
+		return *caDirURL
 	}
-	if len(resp.Kvs) > 0 {
-		crt, err := certcrypto.ParsePEMCertificate(resp.Kvs[0].Value)
-		if err != nil {
-			log.Printf("Failed to parse old private key for your certificate: %v", err)
-		} else {
-			totalValidity := crt.NotAfter.Sub(crt.NotBefore)
-			if crt.NotAfter.Add(-totalValidity / 3).After(time.Now()) {
-				log.Printf("Certificate is valid until %s. Not refreshing.", crt.NotAfter)
-				return
-			}
-		}
+	if *staging {
+		return lego.LEDirectoryStaging
+	}
+	return lego.LEDirectoryProduction
+}
+
+// accountKeyFor returns the etcd key an account for caDirURL is stored under.
+// Namespacing by CA host means switching CAs doesn't clobber an existing
+// account for a different one.
+func accountKeyFor(caDirURL string) string {
+	host := caDirURL
+	if u, err := url.Parse(caDirURL); err == nil && u.Host != "" {
+		host = u.Host
 	}
+	return "/letsencrypt-with-etcd/accounts/" + host
+}
+
+// setupACMEClient loads (or creates) the ACME account stored in etcd for the
+// configured CA and returns a client authenticated as that account, along
+// with the account itself for callers (like revoke) that need to talk to the
+// ACME API directly instead of through the client's higher-level wrappers.
+func setupACMEClient(ctx context.Context, c *clientv3.Client) (*lego.Client, MyUser) {
+	caDirURL := resolveCADirURL()
+	accountKey := accountKeyFor(caDirURL)
 
 	var myUser MyUser
 
-	resp, err = c.Get(ctx, accountKey)
+	resp, err := c.Get(ctx, accountKey)
 	if err != nil {
 		log.Fatalf("Failed to fetch key %s from etcd: %v", accountKey, err)
 	}
@@ -90,9 +154,9 @@ func main() {
 			log.Fatalf("Failed to talk to unmarshal your letsencrypt account (from %s): %v", accountKey, err)
 		}
 	} else {
-		log.Print("Creating new Lets Encrypt account...")
+		log.Printf("Creating new ACME account with %s...", caDirURL)
 		if *email == "" {
-			log.Fatalf("Flag --email (-e) is required if you don't have a Lets Encrypt account stored in %s", accountKey)
+			log.Fatalf("Flag --email (-e) is required if you don't have an account stored in %s", accountKey)
 		}
 		privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 		if err != nil {
@@ -106,69 +170,233 @@ func main() {
 	}
 
 	config := lego.NewConfig(myUser)
-	if *staging {
-		config.CADirURL = lego.LEDirectoryStaging
-	}
-	config.UserAgent = "https://github.com/Jille/letsencrypt-with-etcd"
+	config.CADirURL = caDirURL
+	config.UserAgent = userAgent
 
 	client, err := lego.NewClient(config)
 	if err != nil {
-		log.Fatalf("Failed to connect to Lets Encrypt: %v", err)
+		log.Fatalf("Failed to connect to the ACME CA: %v", err)
 	}
 
 	if myUser.Registration == nil {
-		reg, err := client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
+		var reg *registration.Resource
+		if *eabKID != "" || *eabHMAC != "" {
+			if *eabKID == "" || *eabHMAC == "" {
+				log.Fatal("Flags --eab-kid and --eab-hmac must be set together")
+			}
+			reg, err = client.Registration.RegisterWithExternalAccountBinding(registration.RegisterEABOptions{
+				TermsOfServiceAgreed: true,
+				Kid:                  *eabKID,
+				HmacEncoded:          *eabHMAC,
+			})
+		} else {
+			reg, err = client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
+		}
 		if err != nil {
-			log.Fatalf("Failed to create Lets Encrypt account: %v", err)
+			log.Fatalf("Failed to create account with %s: %v", caDirURL, err)
 		}
 		myUser.Registration = reg
 
 		b, err := json.Marshal(myUser)
 		if err != nil {
-			log.Fatalf("Failed to serialize your new Lets Encrypt account: %v", err)
+			log.Fatalf("Failed to serialize your new account: %v", err)
 		}
 		if _, err := c.Put(ctx, accountKey, string(b)); err != nil {
-			log.Fatalf("Failed to store your new Lets Encrypt account in %s: %v", accountKey, err)
+			log.Fatalf("Failed to store your new account in %s: %v", accountKey, err)
 		}
 	}
 
+	return client, myUser
+}
+
+// findCert returns the config entry whose primary domain is domain.
+func findCert(cfg *Config, domain string) *CertConfig {
+	for i, cert := range cfg.Certificates {
+		if cert.Domains[0] == domain {
+			return &cfg.Certificates[i]
+		}
+	}
+	return nil
+}
+
+// runObtainOrRenew obtains or renews every certificate listed in --config.
+// If force is true (the "obtain" subcommand) certificates are requested
+// regardless of their current validity; otherwise (the "renew" subcommand)
+// only certificates that are missing from etcd, can't be parsed, or are
+// inside their last 1/3 of validity are requested.
+func runObtainOrRenew(ctx context.Context, force bool) {
+	if *configFile == "" {
+		log.Fatal("Flag --config (-c) is required")
+	}
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		log.Fatalf("Failed to load %s: %v", *configFile, err)
+	}
+	if len(cfg.Certificates) == 0 {
+		log.Fatalf("%s lists no certificates under \"certificates\"", *configFile)
+	}
+
+	c := connectEtcd()
+	defer c.Close()
+
+	session, err := concurrency.NewSession(c, concurrency.WithTTL(*lockTTL))
+	if err != nil {
+		log.Fatalf("Failed to create etcd session: %v", err)
+	}
+	defer session.Close()
+
+	if *leaderElect {
+		if err := campaignForLeadership(ctx, session); err != nil {
+			log.Fatalf("Failed to campaign for leadership: %v", err)
+		}
+	}
+
+	client, _ := setupACMEClient(ctx, c)
+
 	log.Print("Preparing for challenge...")
 
-	if err := client.Challenge.SetHTTP01Provider(http01.NewProviderServer("", fmt.Sprint(*port))); err != nil {
-		log.Fatalf("Failed to set up HTTP-01 challenge provider: %v", err)
+	if err := setupChallenge(client); err != nil {
+		log.Fatalf("Failed to set up %s challenge provider: %v", *challengeType, err)
+	}
+
+	for _, cert := range cfg.Certificates {
+		if err := obtainCertificate(ctx, c, session, client, cert, force); err != nil {
+			log.Printf("Failed to process certificate for %v: %v", cert.Domains, err)
+		}
+	}
+}
+
+// obtainCertificate checks whether cert needs renewing and, if so, obtains a
+// new one from Lets Encrypt and writes it to etcd. The check-and-obtain
+// section is guarded by a per-certificate etcd lock so that racing replicas
+// don't both hit Lets Encrypt for the same domain. If force is true the
+// validity check is skipped and a new certificate is always requested.
+func obtainCertificate(ctx context.Context, c *clientv3.Client, session *concurrency.Session, client *lego.Client, cert CertConfig, force bool) error {
+	lockKey := "/letsencrypt-with-etcd/lock/" + cert.Domains[0]
+	mutex := concurrency.NewMutex(session, lockKey)
+	lockCtx, cancel := context.WithTimeout(ctx, *lockTimeout)
+	defer cancel()
+	if err := mutex.Lock(lockCtx); err != nil {
+		return fmt.Errorf("failed to acquire renewal lock %s: %w", lockKey, err)
+	}
+	defer mutex.Unlock(ctx)
+
+	fullChainKey, keyKey := etcdcert.Keys(cert.etcdDirectory(), cert.Domains[0])
+
+	resp, err := c.Get(ctx, fullChainKey)
+	if err != nil {
+		return fmt.Errorf("failed to fetch %s: %w", fullChainKey, err)
+	}
+	if len(resp.Kvs) > 0 && !force {
+		crt, err := certcrypto.ParsePEMCertificate(resp.Kvs[0].Value)
+		if err != nil {
+			log.Printf("Failed to parse old certificate for %v: %v", cert.Domains, err)
+		} else if !etcdcert.NeedsRenewal(crt) {
+			log.Printf("Certificate for %v is valid until %s. Not refreshing.", cert.Domains, crt.NotAfter)
+			return nil
+		}
+	}
+
+	keyType, err := cert.keyType()
+	if err != nil {
+		return err
 	}
 
 	request := certificate.ObtainRequest{
-		Domains: *domains,
-		Bundle:  true,
+		Domains:    cert.Domains,
+		Bundle:     true,
+		MustStaple: cert.MustStaple,
 	}
 
 	resp, err = c.Get(ctx, keyKey)
 	if err != nil {
-		log.Fatalf("Failed to fetch key %s from etcd: %v", keyKey, err)
+		return fmt.Errorf("failed to fetch %s: %w", keyKey, err)
 	}
 	if len(resp.Kvs) > 0 {
 		request.PrivateKey, err = certcrypto.ParsePEMPrivateKey(resp.Kvs[0].Value)
 		if err != nil {
-			log.Printf("Failed to parse old private key for your certificate: %v", err)
+			log.Printf("Failed to parse old private key for %v: %v", cert.Domains, err)
+		}
+	}
+	if request.PrivateKey == nil {
+		request.PrivateKey, err = certcrypto.GeneratePrivateKey(keyType)
+		if err != nil {
+			return fmt.Errorf("failed to create private key: %w", err)
 		}
 	}
 
-	log.Print("Requesting new certificate...")
+	log.Printf("Requesting new certificate for %v...", cert.Domains)
 
 	certificates, err := client.Certificate.Obtain(request)
 	if err != nil {
-		log.Fatalf("Failed to obtain new certificate from Lets Encrypt: %v", err)
+		return fmt.Errorf("failed to obtain new certificate from Lets Encrypt: %w", err)
 	}
 
-	if _, err := c.Txn(ctx).Then(
+	ops := []clientv3.Op{
 		clientv3.OpPut(fullChainKey, string(certificates.Certificate)),
 		clientv3.OpPut(keyKey, string(certificates.PrivateKey)),
-	).Commit(); err != nil {
-		log.Fatalf("Failed to write new certificate: %v", err)
 	}
+	ocspKey := etcdcert.OCSPKey(cert.etcdDirectory(), cert.Domains[0])
+	if op, err := fetchOCSPPut(client, ocspKey, certificates.Certificate); err != nil {
+		// Don't leave the previous certificate's OCSP response behind for
+		// the new one: it's for a different serial, and stays at ocspKey
+		// until the next successful refresh-ocsp.
+		log.Printf("Failed to fetch initial OCSP response for %v: %v", cert.Domains, err)
+		ops = append(ops, clientv3.OpDelete(ocspKey))
+	} else {
+		ops = append(ops, op)
+	}
+
+	if _, err := c.Txn(ctx).Then(ops...).Commit(); err != nil {
+		return fmt.Errorf("failed to write new certificate: %w", err)
+	}
+
+	log.Printf("Acquired new certificate for %v!", cert.Domains)
+	return nil
+}
+
+// setupChallenge configures client's challenge solver according to --challenge.
+// DNS-01 lets us issue wildcard certificates and doesn't require exposing port 80/443;
+// TLS-ALPN-01 is useful when port 80 isn't available but 443 is.
+func setupChallenge(client *lego.Client) error {
+	switch *challengeType {
+	case "http-01":
+		return client.Challenge.SetHTTP01Provider(http01.NewProviderServer("", fmt.Sprint(*port)))
+	case "tls-alpn-01":
+		return client.Challenge.SetTLSALPN01Provider(tlsalpn01.NewProviderServer("", fmt.Sprint(*port)))
+	case "dns-01":
+		if *dnsProvider == "" {
+			log.Fatal("Flag --dns-provider is required when --challenge=dns-01")
+		}
+		provider, err := dns.NewDNSChallengeProviderByName(*dnsProvider)
+		if err != nil {
+			return err
+		}
+		return client.Challenge.SetDNS01Provider(provider,
+			dns01.CondOption(len(*dnsResolvers) > 0,
+				dns01.AddRecursiveNameservers(dns01.ParseNameservers(*dnsResolvers))),
+			dns01.CondOption(*dnsDisableCP,
+				dns01.DisableCompletePropagationRequirement()),
+			dns01.CondOption(*dnsTimeout > 0,
+				dns01.AddDNSTimeout(time.Duration(*dnsTimeout)*time.Second)),
+		)
+	default:
+		return fmt.Errorf("unknown challenge type %q", *challengeType)
+	}
+}
 
-	log.Print("Acquired new certificate!")
+// campaignForLeadership blocks until this process is elected leader over the
+// shared etcd session, so that out of a fleet of replicas racing a schedule,
+// only the leader proceeds to talk to Lets Encrypt.
+func campaignForLeadership(ctx context.Context, session *concurrency.Session) error {
+	hostname, _ := os.Hostname()
+	election := concurrency.NewElection(session, "/letsencrypt-with-etcd/leader/")
+	log.Print("Campaigning for leadership...")
+	if err := election.Campaign(ctx, hostname); err != nil {
+		return err
+	}
+	log.Print("Elected leader.")
+	return nil
 }
 
 type MyUser struct {
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Jille/letsencrypt-with-etcd/etcdcert"
+	"github.com/go-acme/lego/v4/lego"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"golang.org/x/crypto/ocsp"
+)
+
+// fetchOCSPPut fetches a fresh OCSP response for fullChainPEM from the CA's
+// OCSP responder and returns an etcd put op storing it at ocspKey, so it can
+// be committed in the same transaction as the certificate it's for.
+func fetchOCSPPut(client *lego.Client, ocspKey string, fullChainPEM []byte) (clientv3.Op, error) {
+	ocspBytes, _, err := client.Certificate.GetOCSP(fullChainPEM)
+	if err != nil {
+		return clientv3.Op{}, err
+	}
+	return clientv3.OpPut(ocspKey, string(ocspBytes)), nil
+}
+
+// runRefreshOCSP re-fetches the OCSP response for every certificate in
+// --config whose cached response is missing or due to expire within
+// --ocsp-refresh-window.
+func runRefreshOCSP(ctx context.Context) {
+	if *configFile == "" {
+		log.Fatal("Flag --config (-c) is required")
+	}
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		log.Fatalf("Failed to load %s: %v", *configFile, err)
+	}
+
+	c := connectEtcd()
+	defer c.Close()
+
+	client, _ := setupACMEClient(ctx, c)
+
+	for _, cert := range cfg.Certificates {
+		if err := refreshOCSP(ctx, c, client, cert); err != nil {
+			log.Printf("Failed to refresh OCSP response for %v: %v", cert.Domains, err)
+		}
+	}
+}
+
+// refreshOCSP re-fetches cert's OCSP response if the cached one is missing or
+// due to expire within --ocsp-refresh-window, and stores the fresh response
+// in etcd.
+func refreshOCSP(ctx context.Context, c *clientv3.Client, client *lego.Client, cert CertConfig) error {
+	fullChainKey, _ := etcdcert.Keys(cert.etcdDirectory(), cert.Domains[0])
+	ocspKey := etcdcert.OCSPKey(cert.etcdDirectory(), cert.Domains[0])
+
+	resp, err := c.Get(ctx, fullChainKey)
+	if err != nil {
+		return fmt.Errorf("failed to fetch %s: %w", fullChainKey, err)
+	}
+	if len(resp.Kvs) == 0 {
+		return fmt.Errorf("no certificate stored at %s", fullChainKey)
+	}
+	fullChainPEM := resp.Kvs[0].Value
+
+	if old, err := c.Get(ctx, ocspKey); err == nil && len(old.Kvs) > 0 {
+		if parsed, err := ocsp.ParseResponse(old.Kvs[0].Value, nil); err == nil && parsed.NextUpdate.After(time.Now().Add(*ocspRefreshWindow)) {
+			log.Printf("OCSP response for %v is valid until %s. Not refreshing.", cert.Domains, parsed.NextUpdate)
+			return nil
+		}
+	}
+
+	ocspBytes, ocspResp, err := client.Certificate.GetOCSP(fullChainPEM)
+	if err != nil {
+		return fmt.Errorf("failed to fetch OCSP response: %w", err)
+	}
+
+	if _, err := c.Put(ctx, ocspKey, string(ocspBytes)); err != nil {
+		return fmt.Errorf("failed to store OCSP response at %s: %w", ocspKey, err)
+	}
+
+	log.Printf("Refreshed OCSP response for %v, valid until %s.", cert.Domains, ocspResp.NextUpdate)
+	return nil
+}